@@ -1,66 +1,430 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
 	"syscall"
 )
 
+const (
+	zip64ExtraTag = 0x0001
+	aeExtraTag    = 0x9901
+
+	versionNeeded      = 20
+	versionNeededZip64 = 45
+	versionNeededAE    = 51
+	versionMadeBy      = 20
+
+	uint32Max = 0xFFFFFFFF
+	uint16Max = 0xFFFF
+
+	flagDataDescriptor = 1 << 3
+	flagEncrypted      = 1 << 0
+
+	pbkdf2Iterations = 1000
+)
+
 var (
-	localFileHeaderSignature   = []byte{'P', 'K', 3, 4, 10, 0, 8, 0, 8, 0}
-	centralFileHeaderSignature = []byte{'P', 'K', 1, 2, 20, 0, 20, 0, 8, 0, 8, 0}
-	endOfCentralDirSignature   = []byte{'P', 'K', 5, 6, 0, 0, 0, 0, 1, 0, 1, 0}
+	localFileHeaderSignature             = []byte{'P', 'K', 3, 4}
+	centralFileHeaderSignature           = []byte{'P', 'K', 1, 2}
+	endOfCentralDirSignature             = []byte{'P', 'K', 5, 6}
+	zip64EndOfCentralDirSignature        = []byte{'P', 'K', 6, 6}
+	zip64EndOfCentralDirLocatorSignature = []byte{'P', 'K', 6, 7}
 )
 
 func main() {
-	if len(os.Args) != 2 {
+	password := flag.String("p", "", "encrypt output entries with this password (WinZip AES)")
+	keyBits := flag.Int("k", 256, "AES key size when -p is set: 128, 192, or 256")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
 		log.Fatal("usage error")
 	}
 
-	gzipFile := os.Args[1]
-
-	f, err := os.Open(gzipFile)
-	if err != nil {
-		log.Fatalf("file open error: %s", err)
+	var enc *encryptor
+	if *password != "" {
+		switch *keyBits {
+		case 128, 192, 256:
+		default:
+			log.Fatal("key size must be 128, 192, or 256")
+		}
+		enc = &encryptor{password: *password, keyBits: *keyBits}
 	}
-	defer f.Close()
 
 	// stdout should be a pipe
 	w := os.Stdout
 
-	// parse gzip header
-	fileName, gzipOffset := gzipHeader(f)
-
-	// zip file modification date, CRC, and sizes -- initialize to zero for the
-	// local header (the actual CRC and sizes follow the compressed data)
-	var descriptor [16]byte
+	// central directory entries accumulate here -- the zip format requires
+	// every local file entry to precede the central directory, so entries
+	// for earlier members/files can't be flushed until all of them are
+	// written
+	var centralDir bytes.Buffer
 
-	var offset int
+	var offset int64
+	var entries int
+	var partNum int
 
-	// write zip local header
-	locOffset := offset
-	offset += localFileHeader(w, fileName, descriptor)
+	for _, path := range args {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("file open error: %s", err)
+		}
 
-	// write file content
-	compressedSize := fileData(w, f, gzipOffset)
-	offset += compressedSize
+		if isZip(f) {
+			if enc != nil {
+				log.Fatalf("-p is not supported when merging zip input: %s", path)
+			}
+			offset += mergeZipFile(w, f, &centralDir, offset, &entries)
+		} else {
+			offset += convertGzipFile(w, f, &centralDir, offset, &entries, &partNum, enc)
+		}
 
-	// write data descriptor
-	offset += dataDescriptor(w, f, &descriptor, compressedSize)
+		f.Close()
+	}
 
 	// write zip central directory
 	cenOffset := offset
-	offset += centralDirectory(w, descriptor, fileName, locOffset)
+	n, err := w.Write(centralDir.Bytes())
+	if err != nil {
+		log.Fatalf("write error: %s", err)
+	}
+	offset += int64(n)
 
-	//  write end-of-central-directory
+	// write end-of-central-directory
 	endOffset := offset
-	endOfCentralDirectory(w, endOffset-cenOffset, cenOffset)
+	zip64 := uint64(entries) > uint16Max || uint64(endOffset-cenOffset) > uint32Max || uint64(cenOffset) > uint32Max
+	endOfCentralDirectory(w, endOffset-cenOffset, cenOffset, entries, zip64)
+}
+
+// isZip reports whether f starts with a zip local file header signature, as
+// opposed to a gzip member.
+func isZip(f *os.File) bool {
+	var sig [4]byte
+	if _, err := f.ReadAt(sig[:], 0); err != nil {
+		return false
+	}
+	return bytes.Equal(sig[:], localFileHeaderSignature)
 }
 
-func gzipHeader(f *os.File) (string, int) {
+// convertGzipFile converts every member of a gzip file (it may hold more
+// than one concatenated member, as produced by `cat a.gz b.gz` or pigz)
+// into its own zip entry, and returns the number of bytes written to w. When
+// enc is non-nil, every entry is WinZip AES encrypted with its password
+// instead of being streamed through unmodified.
+func convertGzipFile(w, f *os.File, centralDir *bytes.Buffer, offset int64, entries, partNum *int, enc *encryptor) int64 {
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("stat error: %s", err)
+	}
+
+	var written int64
+	var pos int64
+	for pos < fi.Size() {
+		*partNum++
+
+		fileName, comment, headerLen := gzipHeader(f, *partNum)
+		pos += int64(headerLen)
+
+		if enc != nil {
+			deflateLen := deflateStreamLength(f, pos)
+			n := encryptedEntry(w, f, centralDir, fileName, comment, pos, deflateLen, offset+written, enc)
+			written += n
+			pos += deflateLen + 8 // deflate stream plus CRC-32/ISIZE trailer
+			if _, err := f.Seek(pos, io.SeekStart); err != nil {
+				log.Fatalf("seek error: %s", err)
+			}
+			*entries++
+			continue
+		}
+
+		// zip file modification date, CRC, and sizes -- initialize to zero
+		// for the local header (the actual CRC and sizes follow the
+		// compressed data)
+		var descriptor [16]byte
+
+		locOffset := offset + written
+		written += int64(localFileHeader(w, fileName, 8, flagDataDescriptor, 0, 0, 0, false, nil))
+
+		compressedSize := fileData(w, f, pos)
+		written += compressedSize
+		pos += compressedSize
+
+		written += int64(dataDescriptor(w, f, &descriptor, compressedSize))
+		pos += 8 // CRC-32 and ISIZE trailer
+
+		// zip64 is required once any size or offset no longer fits in 32
+		// bits
+		entryCRC32 := binary.LittleEndian.Uint32(descriptor[4:8])
+		uncompressedSize := uint64(binary.LittleEndian.Uint32(descriptor[12:16]))
+		zip64 := uint64(compressedSize) > uint32Max || uncompressedSize > uint32Max || uint64(locOffset) > uint32Max
+
+		centralDirectory(centralDir, fileName, 8, flagDataDescriptor, entryCRC32, uint64(compressedSize), uncompressedSize, locOffset, zip64, nil, comment)
+		*entries++
+	}
+
+	return written
+}
+
+// mergeZipFile copies every entry of an existing zip file into the output
+// zip without decompressing/recompressing, mirroring the raw-entry copy
+// mode added upstream in Go's archive/zip (Writer.Copy). It returns the
+// number of bytes written to w.
+func mergeZipFile(w, f *os.File, centralDir *bytes.Buffer, offset int64, entries *int) int64 {
+	cenOffset, _, count := locateEndOfCentralDir(f)
+	srcEntries := readCentralDirEntries(f, cenOffset, count)
+
+	var written int64
+	for _, e := range srcEntries {
+		locOffset := offset + written
+		zip64 := e.csize > uint32Max || e.usize > uint32Max || uint64(locOffset) > uint32Max
+
+		// sizes are known up front, so bit 3 (data descriptor) never applies
+		// here even though the source entry may have set it
+		flag := e.flag &^ flagDataDescriptor
+
+		written += int64(localFileHeader(w, e.name, e.method, flag, e.crc32, e.csize, e.usize, zip64, e.extra))
+
+		dataStart := localFileDataOffset(f, e.localOffset)
+		n, err := syscall.Splice(int(f.Fd()), &dataStart, int(w.Fd()), nil, int(e.csize), 0)
+		if err != nil {
+			log.Fatalf("splice error: %s", err)
+		}
+		written += n
+
+		centralDirectory(centralDir, e.name, e.method, flag, e.crc32, e.csize, e.usize, locOffset, zip64, e.extra, e.comment)
+		*entries++
+	}
+
+	return written
+}
+
+// zipEntry is the subset of a central directory entry mergeZipFile needs to
+// copy an existing zip entry through unchanged.
+type zipEntry struct {
+	name        string
+	method      uint16
+	flag        uint16
+	crc32       uint32
+	csize       uint64
+	usize       uint64
+	localOffset uint64
+	extra       []byte
+	comment     string
+}
+
+// locateEndOfCentralDir finds f's end-of-central-directory record (and its
+// zip64 counterpart, if present) and returns the central directory's offset
+// and size and the number of entries it holds.
+func locateEndOfCentralDir(f *os.File) (cenOffset, cenSize uint64, entries int) {
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatalf("stat error: %s", err)
+	}
+
+	// the end-of-central-directory record is a fixed 22 bytes plus up to a
+	// 64 KiB comment; search the tail of the file for its signature
+	tailSize := int64(65557)
+	if fi.Size() < tailSize {
+		tailSize = fi.Size()
+	}
+
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, fi.Size()-tailSize); err != nil {
+		log.Fatalf("read error: %s", err)
+	}
+
+	idx := bytes.LastIndex(tail, endOfCentralDirSignature)
+	if idx < 0 {
+		log.Fatal("not a zip file")
+	}
+	eocd := tail[idx:]
+	if len(eocd) < 22 {
+		log.Fatal("truncated end of central directory record")
+	}
+
+	entries = int(binary.LittleEndian.Uint16(eocd[10:12]))
+	cenSize = uint64(binary.LittleEndian.Uint32(eocd[12:16]))
+	cenOffset = uint64(binary.LittleEndian.Uint32(eocd[16:20]))
+
+	if entries != uint16Max && cenSize != uint32Max && cenOffset != uint32Max {
+		return cenOffset, cenSize, entries
+	}
+
+	// the legacy fields are pinned to their sentinel values -- the real
+	// ones live in the zip64 end-of-central-directory record
+	locIdx := bytes.LastIndex(tail[:idx], zip64EndOfCentralDirLocatorSignature)
+	if locIdx < 0 {
+		log.Fatal("zip64 end of central directory locator not found")
+	}
+	recordOffset := binary.LittleEndian.Uint64(tail[locIdx+8 : locIdx+16])
+
+	var record [56]byte
+	if _, err := f.ReadAt(record[:], int64(recordOffset)); err != nil {
+		log.Fatalf("read error: %s", err)
+	}
+
+	entries = int(binary.LittleEndian.Uint64(record[32:40]))
+	cenSize = binary.LittleEndian.Uint64(record[40:48])
+	cenOffset = binary.LittleEndian.Uint64(record[48:56])
+
+	return cenOffset, cenSize, entries
+}
+
+// readCentralDirEntries parses count central directory entries starting at
+// cenOffset.
+func readCentralDirEntries(f *os.File, cenOffset uint64, count int) []zipEntry {
+	entries := make([]zipEntry, 0, count)
+	pos := int64(cenOffset)
+
+	for i := 0; i < count; i++ {
+		var fixed [46]byte
+		if _, err := f.ReadAt(fixed[:], pos); err != nil {
+			log.Fatalf("central directory read error: %s", err)
+		}
+		if !bytes.Equal(fixed[0:4], centralFileHeaderSignature) {
+			log.Fatal("bad central directory entry")
+		}
+
+		flag := binary.LittleEndian.Uint16(fixed[8:10])
+		method := binary.LittleEndian.Uint16(fixed[10:12])
+		crc32 := binary.LittleEndian.Uint32(fixed[16:20])
+		csize := uint64(binary.LittleEndian.Uint32(fixed[20:24]))
+		usize := uint64(binary.LittleEndian.Uint32(fixed[24:28]))
+		nameLen := binary.LittleEndian.Uint16(fixed[28:30])
+		extraLen := binary.LittleEndian.Uint16(fixed[30:32])
+		commentLen := binary.LittleEndian.Uint16(fixed[32:34])
+		localOffset := uint64(binary.LittleEndian.Uint32(fixed[42:46]))
+
+		name := make([]byte, nameLen)
+		if _, err := f.ReadAt(name, pos+46); err != nil {
+			log.Fatalf("central directory read error: %s", err)
+		}
+
+		extra := make([]byte, extraLen)
+		if _, err := f.ReadAt(extra, pos+46+int64(nameLen)); err != nil {
+			log.Fatalf("central directory read error: %s", err)
+		}
+
+		comment := make([]byte, commentLen)
+		if _, err := f.ReadAt(comment, pos+46+int64(nameLen)+int64(extraLen)); err != nil {
+			log.Fatalf("central directory read error: %s", err)
+		}
+
+		usize, csize, localOffset = applyZip64Extra(extra, usize, csize, localOffset)
+
+		entries = append(entries, zipEntry{
+			name:        string(name),
+			method:      method,
+			flag:        flag,
+			crc32:       crc32,
+			csize:       csize,
+			usize:       usize,
+			localOffset: localOffset,
+			extra:       stripZip64Extra(extra),
+			comment:     string(comment),
+		})
+
+		pos += 46 + int64(nameLen) + int64(extraLen) + int64(commentLen)
+	}
+
+	return entries
+}
+
+// applyZip64Extra overrides usize, csize, and localOffset with the values
+// from a Zip64 Extended Information extra field, for whichever of them were
+// left at their 32-bit sentinel.
+func applyZip64Extra(extra []byte, usize, csize, localOffset uint64) (uint64, uint64, uint64) {
+	needUsize := usize == uint32Max
+	needCsize := csize == uint32Max
+	needOffset := localOffset == uint32Max
+
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra[0:2])
+		size := binary.LittleEndian.Uint16(extra[2:4])
+		if len(extra) < 4+int(size) {
+			break
+		}
+		data := extra[4 : 4+int(size)]
+
+		if tag == zip64ExtraTag {
+			if needUsize && len(data) >= 8 {
+				usize = binary.LittleEndian.Uint64(data[0:8])
+				data = data[8:]
+			}
+			if needCsize && len(data) >= 8 {
+				csize = binary.LittleEndian.Uint64(data[0:8])
+				data = data[8:]
+			}
+			if needOffset && len(data) >= 8 {
+				localOffset = binary.LittleEndian.Uint64(data[0:8])
+			}
+		}
+
+		extra = extra[4+int(size):]
+	}
+
+	return usize, csize, localOffset
+}
+
+// stripZip64Extra returns extra with any Zip64 Extended Information
+// sub-fields (tag 0x0001) removed, leaving every other vendor sub-field
+// (e.g. WinZip AE, tag 0x9901) untouched. It's used when re-emitting a
+// merged entry's extra field: the source's zip64 sizes/offset are stale
+// once the entry is re-laid-out, but localFileHeader/centralDirectory
+// already rebuild that sub-field themselves from the new values.
+func stripZip64Extra(extra []byte) []byte {
+	var kept []byte
+
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra[0:2])
+		size := binary.LittleEndian.Uint16(extra[2:4])
+		if len(extra) < 4+int(size) {
+			break
+		}
+
+		if tag != zip64ExtraTag {
+			kept = append(kept, extra[:4+int(size)]...)
+		}
+
+		extra = extra[4+int(size):]
+	}
+
+	return kept
+}
+
+// localFileDataOffset reads the local file header at localOffset and
+// returns the absolute offset of the entry's data, just past the header,
+// name, and extra field.
+func localFileDataOffset(f *os.File, localOffset uint64) int64 {
+	var fixed [30]byte
+	if _, err := f.ReadAt(fixed[:], int64(localOffset)); err != nil {
+		log.Fatalf("local file header read error: %s", err)
+	}
+	if !bytes.Equal(fixed[0:4], localFileHeaderSignature) {
+		log.Fatal("bad local file header")
+	}
+
+	nameLen := binary.LittleEndian.Uint16(fixed[26:28])
+	extraLen := binary.LittleEndian.Uint16(fixed[28:30])
+
+	return int64(localOffset) + 30 + int64(nameLen) + int64(extraLen)
+}
+
+func gzipHeader(f *os.File, partNum int) (string, string, int) {
 	// gzip header
 	var header [10]byte
 
@@ -81,9 +445,27 @@ func gzipHeader(f *os.File) (string, int) {
 		log.Fatal("invalid flag")
 	}
 
-	// TODO: extra field (ignore)
+	// the FHCRC, if present, covers every header byte read so far
+	var raw bytes.Buffer
+	raw.Write(header[:])
+
+	// extra field (skip; its bytes only count toward the header crc)
 	if header[3]&4 > 0 {
-		log.Fatal("extra field not implemented yet")
+		var extraLen [2]byte
+		if n, err = f.Read(extraLen[:]); err != nil {
+			log.Fatalf("extra field read error: %s", err)
+		}
+		offset += n
+		raw.Write(extraLen[:])
+
+		extra := make([]byte, binary.LittleEndian.Uint16(extraLen[:]))
+		if len(extra) > 0 {
+			if n, err = io.ReadFull(f, extra); err != nil {
+				log.Fatalf("extra field read error: %s", err)
+			}
+			offset += n
+			raw.Write(extra)
+		}
 	}
 
 	// file name (save)
@@ -96,6 +478,7 @@ func gzipHeader(f *os.File) (string, int) {
 				log.Fatalf("read error: %s", err)
 			}
 			offset += n
+			raw.Write(b)
 
 			if b[0] == 0 {
 				break
@@ -103,44 +486,113 @@ func gzipHeader(f *os.File) (string, int) {
 			name.Write(b)
 		}
 		fileName = name.String()
-	} else { // no file name
-		fileName = "-"
+	} else { // no file name -- synthesize a unique one
+		fileName = fmt.Sprintf("part-%04d", partNum)
 	}
 
-	// TODO: comment (ignore)
+	// comment (save, stored in the zip central directory's file comment)
+	var comment string
 	if header[3]&16 > 0 {
-		log.Fatal("comment not implemented yet")
+		var c bytes.Buffer
+		b := make([]byte, 1)
+		for {
+			if n, err = f.Read(b); err != nil {
+				log.Fatalf("read error: %s", err)
+			}
+			offset += n
+			raw.Write(b)
+
+			if b[0] == 0 {
+				break
+			}
+			c.Write(b)
+		}
+		comment = c.String()
 	}
 
-	// TODO: header crc (ignore)
+	// header crc (verify)
 	if header[3]&2 > 0 {
-		log.Fatal("header crc not implemented yet")
+		var hcrc [2]byte
+		if n, err = f.Read(hcrc[:]); err != nil {
+			log.Fatalf("header crc read error: %s", err)
+		}
+		offset += n
+
+		want := binary.LittleEndian.Uint16(hcrc[:])
+		got := uint16(crc32.ChecksumIEEE(raw.Bytes()))
+		if got != want {
+			log.Fatal("header crc mismatch")
+		}
 	}
 
-	return fileName, offset
+	return fileName, comment, offset
 }
 
-func localFileHeader(w io.Writer, fileName string, descriptor [16]byte) int {
+// versionNeededFor returns the "version needed to extract" value for an
+// entry compressed with method, upgrading to versionNeededZip64 or, for
+// WinZip AE (method 99) entries, versionNeededAE as the format requires.
+func versionNeededFor(method uint16, zip64 bool) byte {
+	if method == 99 {
+		return versionNeededAE
+	}
+	if zip64 {
+		return versionNeededZip64
+	}
+	return versionNeeded
+}
+
+// localFileHeader writes a zip local file header with the given crc32, csize
+// and usize. In streaming mode (flag&8) these are unknown at this point and
+// the caller passes zero -- the real values follow in a data descriptor. extra, if
+// non-nil, is additional vendor extra field data (already in tag/size/data
+// form) appended after the zip64 extra field.
+func localFileHeader(w io.Writer, fileName string, method, flag uint16, crc32 uint32, csize, usize uint64, zip64 bool, extra []byte) int {
 	var header []byte
 
 	// local file header signature
 	header = append(header, localFileHeaderSignature...)
 
-	// TODO: last mod file time & last mod file data
-	// CRC-32 and sizes(the actual CRC will be in data descriptor)
-	header = append(header, descriptor[:]...)
+	// version needed to extract
+	header = append(header, versionNeededFor(method, zip64), 0)
+
+	// general purpose bit flag, compression method
+	var flagAndMethod [4]byte
+	binary.LittleEndian.PutUint16(flagAndMethod[0:2], flag)
+	binary.LittleEndian.PutUint16(flagAndMethod[2:4], method)
+	header = append(header, flagAndMethod[:]...)
+
+	// TODO: last mod file time & last mod file date
+	header = append(header, 0, 0, 0, 0)
+
+	// CRC-32 and sizes
+	var crcAndSizes [12]byte
+	binary.LittleEndian.PutUint32(crcAndSizes[0:4], crc32)
+	if zip64 {
+		binary.LittleEndian.PutUint32(crcAndSizes[4:8], uint32Max)
+		binary.LittleEndian.PutUint32(crcAndSizes[8:12], uint32Max)
+	} else {
+		binary.LittleEndian.PutUint32(crcAndSizes[4:8], uint32(csize))
+		binary.LittleEndian.PutUint32(crcAndSizes[8:12], uint32(usize))
+	}
+	header = append(header, crcAndSizes[:]...)
 
 	// file name length
 	var nameLen [2]byte
 	binary.LittleEndian.PutUint16(nameLen[:], uint16(len(fileName)))
 	header = append(header, nameLen[:]...)
 
-	// extra field length
-	header = append(header, 0, 0)
+	// extra field
+	allExtra := append(zip64ExtraField(zip64, usize, csize, 0, false), extra...)
+	var extraLen [2]byte
+	binary.LittleEndian.PutUint16(extraLen[:], uint16(len(allExtra)))
+	header = append(header, extraLen[:]...)
 
 	// filename
 	header = append(header, []byte(fileName)...)
 
+	// extra field
+	header = append(header, allExtra...)
+
 	n, err := w.Write(header)
 	if err != nil {
 		log.Fatal(err)
@@ -149,27 +601,52 @@ func localFileHeader(w io.Writer, fileName string, descriptor [16]byte) int {
 	return n
 }
 
-func fileData(w, f *os.File, gzipOffset int) int {
-	fi, err := f.Stat()
-	if err != nil {
-		log.Fatalf("stat error: %s", err)
-	}
+// fileData splices the raw deflate stream for the member starting at start
+// from f to w, zero-copy. The member's length isn't known up front -- a
+// gzip file may hold more data after it (another concatenated member) -- so
+// deflateStreamLength decodes it first to find where it ends.
+func fileData(w, f *os.File, start int64) int64 {
+	deflateLen := deflateStreamLength(f, start)
 
-	// copy raw deflate stream, saving eight-byte gzip trailer
-	offset := int64(gzipOffset)
-	n, err := syscall.Splice(int(f.Fd()), &offset, int(w.Fd()), nil, int(fi.Size()-8-offset), 0)
+	offset := start
+	n, err := syscall.Splice(int(f.Fd()), &offset, int(w.Fd()), nil, int(deflateLen), 0)
 	if err != nil {
 		log.Fatalf("splice error: %s", err)
 	}
 
-	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+	if _, err = f.Seek(start+n, io.SeekStart); err != nil {
 		log.Fatalf("seek error: %s", err)
 	}
 
-	return int(n)
+	return n
 }
 
-func dataDescriptor(w io.Writer, f *os.File, descriptor *[16]byte, csize int) int {
+// deflateStreamLength returns the length in bytes of the deflate stream
+// starting at start by decoding it and discarding the output. f's position
+// is left somewhere past the end of the stream; callers that go on reading
+// f seek to the position they need themselves.
+func deflateStreamLength(f *os.File, start int64) int64 {
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		log.Fatalf("seek error: %s", err)
+	}
+
+	br := bufio.NewReader(f)
+	fr := flate.NewReader(br)
+	if _, err := io.Copy(io.Discard, fr); err != nil {
+		log.Fatalf("deflate decode error: %s", err)
+	}
+	fr.Close()
+
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		log.Fatalf("seek error: %s", err)
+	}
+
+	// br may have buffered bytes past the end of the deflate stream
+	return pos - int64(br.Buffered()) - start
+}
+
+func dataDescriptor(w io.Writer, f *os.File, descriptor *[16]byte, csize int64) int {
 	// parse gzip trailer
 	var crc, size [4]byte
 	if _, err := f.Read(crc[:]); err != nil {
@@ -190,6 +667,27 @@ func dataDescriptor(w io.Writer, f *os.File, descriptor *[16]byte, csize int) in
 	// decompressed size
 	copy(descriptor[12:16], size[:])
 
+	usize := binary.LittleEndian.Uint32(size[:])
+
+	// switch to the 8-byte data descriptor variant once either size no
+	// longer fits in 32 bits
+	if uint64(csize) > uint32Max || uint64(usize) > uint32Max {
+		var buf []byte
+		buf = append(buf, crc[:]...)
+
+		var csize64, usize64 [8]byte
+		binary.LittleEndian.PutUint64(csize64[:], uint64(csize))
+		binary.LittleEndian.PutUint64(usize64[:], uint64(usize))
+		buf = append(buf, csize64[:]...)
+		buf = append(buf, usize64[:]...)
+
+		n, err := w.Write(buf)
+		if err != nil {
+			log.Fatalf("write error: %s", err)
+		}
+		return n
+	}
+
 	// the first 4 bytes are not needed here
 	n, err := w.Write(descriptor[4:])
 	if err != nil {
@@ -198,32 +696,75 @@ func dataDescriptor(w io.Writer, f *os.File, descriptor *[16]byte, csize int) in
 	return n
 }
 
-func centralDirectory(w io.Writer, descriptor [16]byte, fileName string, locOffset int) int {
+// centralDirectory writes a zip central directory entry. extra, if non-nil,
+// is additional vendor extra field data (already in tag/size/data form)
+// appended after the zip64 extra field. comment becomes the entry's file
+// comment, e.g. preserved from a source gzip member's FCOMMENT field.
+func centralDirectory(w io.Writer, fileName string, method, flag uint16, crc32 uint32, csize, usize uint64, locOffset int64, zip64 bool, extra []byte, comment string) int {
 	var header []byte
 
 	// central file header signature
 	header = append(header, centralFileHeaderSignature...)
 
-	// modification date, CRC, and sizes
-	header = append(header, descriptor[:]...)
+	// version made by, version needed to extract
+	header = append(header, versionMadeBy, 0, versionNeededFor(method, zip64), 0)
+
+	// general purpose bit flag, compression method
+	var flagAndMethod [4]byte
+	binary.LittleEndian.PutUint16(flagAndMethod[0:2], flag)
+	binary.LittleEndian.PutUint16(flagAndMethod[2:4], method)
+	header = append(header, flagAndMethod[:]...)
+
+	// modification date
+	header = append(header, 0, 0, 0, 0)
+
+	// CRC-32 and sizes
+	var crcAndSizes [12]byte
+	binary.LittleEndian.PutUint32(crcAndSizes[0:4], crc32)
+	if zip64 {
+		// sentinels -- the real values live in the zip64 extra field below
+		binary.LittleEndian.PutUint32(crcAndSizes[4:8], uint32Max)
+		binary.LittleEndian.PutUint32(crcAndSizes[8:12], uint32Max)
+	} else {
+		binary.LittleEndian.PutUint32(crcAndSizes[4:8], uint32(csize))
+		binary.LittleEndian.PutUint32(crcAndSizes[8:12], uint32(usize))
+	}
+	header = append(header, crcAndSizes[:]...)
 
 	// file name length
 	var nameLen [2]byte
 	binary.LittleEndian.PutUint16(nameLen[:], uint16(len(fileName)))
 	header = append(header, nameLen[:]...)
 
-	// extra field, etc.
-	var extra [12]byte
-	header = append(header, extra[:]...)
+	// extra field
+	allExtra := append(zip64ExtraField(zip64, usize, csize, uint64(locOffset), true), extra...)
+	var extraLen [2]byte
+	binary.LittleEndian.PutUint16(extraLen[:], uint16(len(allExtra)))
+	header = append(header, extraLen[:]...)
+
+	// comment length, disk number start, internal/external file attributes
+	var rest [10]byte
+	binary.LittleEndian.PutUint16(rest[0:2], uint16(len(comment)))
+	header = append(header, rest[:]...)
 
 	// local directory offset
 	var offset [4]byte
-	binary.LittleEndian.PutUint32(offset[:], uint32(locOffset))
+	if zip64 && uint64(locOffset) > uint32Max {
+		binary.LittleEndian.PutUint32(offset[:], uint32Max)
+	} else {
+		binary.LittleEndian.PutUint32(offset[:], uint32(locOffset))
+	}
 	header = append(header, offset[:]...)
 
 	// filename
 	header = append(header, []byte(fileName)...)
 
+	// extra field
+	header = append(header, allExtra...)
+
+	// file comment
+	header = append(header, []byte(comment)...)
+
 	n, err := w.Write(header)
 	if err != nil {
 		log.Fatalf("write error: %s", err)
@@ -232,20 +773,238 @@ func centralDirectory(w io.Writer, descriptor [16]byte, fileName string, locOffs
 	return n
 }
 
-func endOfCentralDirectory(w *os.File, centralSize, centralOffset int) {
+// zip64ExtraField builds the Zip64 Extended Information extra field (tag
+// 0x0001). The local file header only ever carries the uncompressed and
+// compressed sizes (includeOffset false); the central directory entry also
+// carries the relative header offset. It returns nil when zip64 isn't
+// needed.
+func zip64ExtraField(zip64 bool, usize, csize, locOffset uint64, includeOffset bool) []byte {
+	if !zip64 {
+		return nil
+	}
+
+	size := uint16(16)
+	if includeOffset {
+		size = 24
+	}
+
+	var tag, extraSize [2]byte
+	binary.LittleEndian.PutUint16(tag[:], zip64ExtraTag)
+	binary.LittleEndian.PutUint16(extraSize[:], size)
+
+	var data [24]byte
+	binary.LittleEndian.PutUint64(data[0:8], usize)
+	binary.LittleEndian.PutUint64(data[8:16], csize)
+	binary.LittleEndian.PutUint64(data[16:24], locOffset)
+
+	var extra []byte
+	extra = append(extra, tag[:]...)
+	extra = append(extra, extraSize[:]...)
+	extra = append(extra, data[:size]...)
+	return extra
+}
+
+// encryptor holds the password and key size selected by the -p/-k flags for
+// WinZip AES (AE-2) encrypted output entries.
+type encryptor struct {
+	password string
+	keyBits  int
+}
+
+// encryptedEntry reads the plaintext deflate stream for the member starting
+// at start (deflateLen bytes long, followed immediately by its gzip
+// trailer), encrypts it per the WinZip AES (AE-2) extension, and writes the
+// resulting local file header, entry data, and central directory entry. It
+// returns the number of bytes written to w.
+func encryptedEntry(w, f *os.File, centralDir *bytes.Buffer, fileName, comment string, start, deflateLen, locOffset int64, enc *encryptor) int64 {
+	plain := make([]byte, deflateLen)
+	if _, err := f.ReadAt(plain, start); err != nil {
+		log.Fatalf("read error: %s", err)
+	}
+
+	var trailer [8]byte
+	if _, err := f.ReadAt(trailer[:], start+deflateLen); err != nil {
+		log.Fatalf("gzip trailer read error: %s", err)
+	}
+	usize := uint64(binary.LittleEndian.Uint32(trailer[4:8]))
+
+	payload, keyBits := aeEncrypt(plain, enc.password, enc.keyBits)
+	csize := uint64(len(payload))
+
+	zip64 := csize > uint32Max || usize > uint32Max || uint64(locOffset) > uint32Max
+	extra := aeExtraField(keyBits)
+
+	// AE-2 stores CRC-32 as zero; integrity is verified via the HMAC
+	// authentication code appended to the entry data instead. csize/usize
+	// are already known, so bit 3 (data descriptor) is left unset and no
+	// descriptor follows the entry data.
+	n := int64(localFileHeader(w, fileName, 99, flagEncrypted, 0, csize, usize, zip64, extra))
+
+	if _, err := w.Write(payload); err != nil {
+		log.Fatalf("write error: %s", err)
+	}
+	n += int64(len(payload))
+
+	centralDirectory(centralDir, fileName, 99, flagEncrypted, 0, csize, usize, locOffset, zip64, extra, comment)
+
+	return n
+}
+
+// aeEncrypt encrypts plain per the WinZip AES (AE-2) extension and returns
+// the entry data: a random salt, a 2-byte password verification value, the
+// AES-CTR ciphertext, and a 10-byte HMAC-SHA1 authentication code.
+func aeEncrypt(plain []byte, password string, keyBits int) (payload []byte, _ int) {
+	keyLen := keyBits / 8
+	saltLen := keyBits / 16
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		log.Fatalf("random error: %s", err)
+	}
+
+	derived := pbkdf2HMACSHA1([]byte(password), salt, pbkdf2Iterations, 2*keyLen+2)
+	aesKey, hmacKey, pv := derived[:keyLen], derived[keyLen:2*keyLen], derived[2*keyLen:]
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		log.Fatalf("aes error: %s", err)
+	}
+	ciphertext := append([]byte(nil), plain...)
+	aesCTR(block, ciphertext)
+
+	mac := hmac.New(sha1.New, hmacKey)
+	mac.Write(ciphertext)
+	authCode := mac.Sum(nil)[:10]
+
+	payload = append(payload, salt...)
+	payload = append(payload, pv...)
+	payload = append(payload, ciphertext...)
+	payload = append(payload, authCode...)
+	return payload, keyBits
+}
+
+// aesCTR encrypts data in place with AES-CTR as specified by the WinZip AES
+// extension: a 16-byte counter block starting at 1, stored little-endian
+// and incremented once per 16-byte block (unlike the big-endian counter
+// crypto/cipher.NewCTR implements).
+func aesCTR(block cipher.Block, data []byte) {
+	blockSize := block.BlockSize()
+
+	var counter uint64 = 1
+	var iv, keystream [16]byte
+	for off := 0; off < len(data); off += blockSize {
+		binary.LittleEndian.PutUint64(iv[:8], counter)
+		block.Encrypt(keystream[:], iv[:])
+
+		end := off + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		for i := off; i < end; i++ {
+			data[i] ^= keystream[i-off]
+		}
+
+		counter++
+	}
+}
+
+// pbkdf2HMACSHA1 derives keyLen bytes of key material from password and
+// salt using PBKDF2 (RFC 2898) with HMAC-SHA1 as the pseudorandom function.
+func pbkdf2HMACSHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	hashLen := prf.Size()
+
+	dk := make([]byte, 0, (keyLen/hashLen+1)*hashLen)
+	var blockNum [4]byte
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(blockNum[:], block)
+		prf.Write(blockNum[:])
+
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		dk = append(dk, t...)
+	}
+
+	return dk[:keyLen]
+}
+
+// aeExtraField builds the WinZip AES extra field (tag 0x9901) describing
+// AE-2, the actual compression method (deflate), and the key strength.
+func aeExtraField(keyBits int) []byte {
+	var tag, size [2]byte
+	binary.LittleEndian.PutUint16(tag[:], aeExtraTag)
+	binary.LittleEndian.PutUint16(size[:], 7)
+
+	var data [7]byte
+	binary.LittleEndian.PutUint16(data[0:2], 2) // AE-2
+	data[2], data[3] = 'A', 'E'                 // vendor ID
+	switch keyBits {
+	case 128:
+		data[4] = 1
+	case 192:
+		data[4] = 2
+	case 256:
+		data[4] = 3
+	}
+	binary.LittleEndian.PutUint16(data[5:7], 8) // actual compression method: deflate
+
+	var extra []byte
+	extra = append(extra, tag[:]...)
+	extra = append(extra, size[:]...)
+	extra = append(extra, data[:]...)
+	return extra
+}
+
+func endOfCentralDirectory(w *os.File, centralSize, centralOffset int64, entries int, zip64 bool) {
+	if zip64 {
+		zip64EndOfCentralDirectory(w, centralSize, centralOffset, entries)
+	}
+
 	var header []byte
 
 	// end of central directory header signature
 	header = append(header, endOfCentralDirSignature...)
 
+	// disk number, disk with central dir
+	header = append(header, 0, 0, 0, 0)
+
+	// entries on this disk, total entries
+	var count [2]byte
+	if entries > uint16Max {
+		binary.LittleEndian.PutUint16(count[:], uint16Max)
+	} else {
+		binary.LittleEndian.PutUint16(count[:], uint16(entries))
+	}
+	header = append(header, count[:]...)
+	header = append(header, count[:]...)
+
 	// central directory size
 	var size [4]byte
-	binary.LittleEndian.PutUint32(size[:], uint32(centralSize))
+	if zip64 && uint64(centralSize) > uint32Max {
+		binary.LittleEndian.PutUint32(size[:], uint32Max)
+	} else {
+		binary.LittleEndian.PutUint32(size[:], uint32(centralSize))
+	}
 	header = append(header, size[:]...)
 
 	// central directory offset
 	var offset [4]byte
-	binary.LittleEndian.PutUint32(offset[:], uint32(centralOffset))
+	if zip64 && uint64(centralOffset) > uint32Max {
+		binary.LittleEndian.PutUint32(offset[:], uint32Max)
+	} else {
+		binary.LittleEndian.PutUint32(offset[:], uint32(centralOffset))
+	}
 	header = append(header, offset[:]...)
 
 	// comment
@@ -255,3 +1014,60 @@ func endOfCentralDirectory(w *os.File, centralSize, centralOffset int) {
 		log.Fatalf("write error: %s", err)
 	}
 }
+
+// zip64EndOfCentralDirectory writes the Zip64 End of Central Directory
+// Record and its Locator, which precede the standard end-of-central-
+// directory record once any size, offset, or entry count no longer fits in
+// its legacy field.
+func zip64EndOfCentralDirectory(w *os.File, centralSize, centralOffset int64, entries int) {
+	var record []byte
+	record = append(record, zip64EndOfCentralDirSignature...)
+
+	// size of the zip64 EOCD record itself (fixed portion, excluding the
+	// leading signature and this size field)
+	var recordSize [8]byte
+	binary.LittleEndian.PutUint64(recordSize[:], 44)
+	record = append(record, recordSize[:]...)
+
+	// version made by, version needed to extract
+	record = append(record, versionMadeBy, 0, versionNeededZip64, 0)
+
+	// disk number, disk with central dir
+	record = append(record, 0, 0, 0, 0)
+
+	// entries on this disk, total entries
+	var count [8]byte
+	binary.LittleEndian.PutUint64(count[:], uint64(entries))
+	record = append(record, count[:]...)
+	record = append(record, count[:]...)
+
+	// central directory size and offset
+	var size, offset [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(centralSize))
+	binary.LittleEndian.PutUint64(offset[:], uint64(centralOffset))
+	record = append(record, size[:]...)
+	record = append(record, offset[:]...)
+
+	eocdOffset := centralOffset + centralSize
+
+	var locator []byte
+	locator = append(locator, zip64EndOfCentralDirLocatorSignature...)
+
+	// disk with the zip64 EOCD record
+	locator = append(locator, 0, 0, 0, 0)
+
+	// zip64 EOCD record offset
+	var recordOffset [8]byte
+	binary.LittleEndian.PutUint64(recordOffset[:], uint64(eocdOffset))
+	locator = append(locator, recordOffset[:]...)
+
+	// total number of disks
+	locator = append(locator, 1, 0, 0, 0)
+
+	if _, err := w.Write(record); err != nil {
+		log.Fatalf("write error: %s", err)
+	}
+	if _, err := w.Write(locator); err != nil {
+		log.Fatalf("write error: %s", err)
+	}
+}